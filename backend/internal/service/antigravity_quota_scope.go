@@ -60,29 +60,46 @@ func (a *Account) IsSchedulableForModel(requestedModel string) bool {
 }
 
 func (a *Account) IsSchedulableForModelWithContext(ctx context.Context, requestedModel string) bool {
+	return a.IsSchedulableForModelAndCategoryWithContext(ctx, requestedModel, "")
+}
+
+// IsSchedulableForModelAndCategoryWithContext 结合模型级限流判断是否可调度，且只
+// 考虑命中给定 category 的限流记录。例如一个账号的 output_tokens 被限流时，
+// 仍然可以调度只消耗 requests/input_tokens 额度的请求。
+// category 传空字符串表示不按类别过滤，退化为 IsSchedulableForModelWithContext 的行为。
+func (a *Account) IsSchedulableForModelAndCategoryWithContext(ctx context.Context, requestedModel string, category RateLimitCategory) bool {
 	if a == nil {
 		return false
 	}
 	if !a.IsSchedulable() {
 		return false
 	}
-	if a.isModelRateLimitedWithContext(ctx, requestedModel) {
+	if a.isModelRateLimitedForCategoryWithContext(ctx, requestedModel, category) {
 		return false
 	}
 	return true
 }
 
-// GetRateLimitRemainingTime 获取限流剩余时间（模型级限流）
+// GetRateLimitRemainingTime 获取限流剩余时间（登记簿中命中该模型的所有 scope 里最长的一个）
 // 返回 0 表示未限流或已过期
 func (a *Account) GetRateLimitRemainingTime(requestedModel string) time.Duration {
 	return a.GetRateLimitRemainingTimeWithContext(context.Background(), requestedModel)
 }
 
-// GetRateLimitRemainingTimeWithContext 获取限流剩余时间（模型级限流）
+// GetRateLimitRemainingTimeWithContext 获取限流剩余时间，不区分 category。
+// 同一模型可能同时命中多个 scope（例如模型族限流叠加单模型限流），
+// 此时返回所有命中记录中最长的剩余时间，而不是只看某一个 scope。
 // 返回 0 表示未限流或已过期
 func (a *Account) GetRateLimitRemainingTimeWithContext(ctx context.Context, requestedModel string) time.Duration {
+	return a.GetRateLimitRemainingTimeForCategory(ctx, requestedModel, "")
+}
+
+// GetRateLimitRemainingTimeForCategory 获取限流剩余时间，只统计命中给定 category 的记录。
+// category 传空字符串表示不按类别过滤，退化为 GetRateLimitRemainingTimeWithContext 的行为。
+// 返回 0 表示未限流或已过期
+func (a *Account) GetRateLimitRemainingTimeForCategory(ctx context.Context, requestedModel string, category RateLimitCategory) time.Duration {
 	if a == nil {
 		return 0
 	}
-	return a.GetModelRateLimitRemainingTimeWithContext(ctx, requestedModel)
+	return a.GetModelRateLimitRemainingTimeForCategory(ctx, requestedModel, category)
 }
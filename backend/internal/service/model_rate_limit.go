@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Platform 表示账号所属的上游平台
+type Platform string
+
+const (
+	PlatformClaude      Platform = "claude"
+	PlatformGemini      Platform = "gemini"
+	PlatformAntigravity Platform = "antigravity"
+)
+
+// Account 描述一个可调度的上游账号
+//
+// 本文件只保留限流/调度相关的字段，供 service 包内的调度逻辑使用。
+//
+// Account 持有一个 sync.Mutex 字段（rateLimitMu），构造之后不可再按值拷贝或赋值
+// （go vet 的 copylocks 检查会捕获大部分误用）；调用方应当始终传递 *Account。
+type Account struct {
+	ID          string
+	Platform    Platform
+	Credentials map[string]any
+	Extra       map[string]any
+
+	// RateLimits 是账号级的限流登记簿，参考 Sentry Relay 的配额模型设计：
+	// 每条记录独立描述一次限流命中的 scope、category、原因与恢复时间，
+	// 允许 AccountGlobal、ModelFamily、Model 等多个 scope 的限流同时生效。
+	RateLimits []RateLimitEntry
+
+	// rateLimitMu 保护 RateLimits 以及 Extra[modelRateLimitsKey] 的读写。
+	// 调度热路径（isModelRateLimitedWithContext 等）与上游 429 处理
+	// （RecordRateLimit/IngestUpstreamRateLimit）都会并发访问同一个 *Account，
+	// 这里需要串行化，否则会在历史格式迁移时产生并发 map 写入。
+	rateLimitMu sync.Mutex
+}
+
+// modelRateLimitsKey 是 Extra 中存放模型级限流记录的键
+const modelRateLimitsKey = "model_rate_limits"
+
+// GetMappedModel 按账号的 model_mapping 凭证配置将请求模型名做一次映射，
+// 未配置映射或映射缺失时返回原始模型名。
+func (a *Account) GetMappedModel(requestedModel string) string {
+	if a == nil {
+		return requestedModel
+	}
+	mapping, ok := a.Credentials["model_mapping"].(map[string]any)
+	if !ok {
+		return requestedModel
+	}
+	if mapped, ok := mapping[requestedModel].(string); ok && mapped != "" {
+		return mapped
+	}
+	return requestedModel
+}
+
+// isImageGenerationModel 判断模型名是否属于图像生成类模型
+func isImageGenerationModel(model string) bool {
+	return strings.Contains(model, "-image")
+}
+
+// RateLimitScope 描述一条限流记录的生效范围
+type RateLimitScope string
+
+const (
+	// RateLimitScopeAccountGlobal 账号维度，影响该账号下的所有请求
+	RateLimitScopeAccountGlobal RateLimitScope = "account_global"
+	// RateLimitScopePlatform 平台维度（claude/gemini/antigravity）
+	RateLimitScopePlatform RateLimitScope = "platform"
+	// RateLimitScopeModelFamily 模型族维度，对应 AntigravityQuotaScope（claude/gemini_text/gemini_image）
+	RateLimitScopeModelFamily RateLimitScope = "model_family"
+	// RateLimitScopeModel 具体模型 id 维度
+	RateLimitScopeModel RateLimitScope = "model"
+	// RateLimitScopeCredential 单个凭证（key）维度
+	RateLimitScopeCredential RateLimitScope = "credential"
+)
+
+// RateLimitCategory 描述限流记录统计的资源类别；空值表示对该 scope 下的所有类别生效
+type RateLimitCategory string
+
+const (
+	RateLimitCategoryRequests        RateLimitCategory = "requests"
+	RateLimitCategoryInputTokens     RateLimitCategory = "input_tokens"
+	RateLimitCategoryOutputTokens    RateLimitCategory = "output_tokens"
+	RateLimitCategoryImages          RateLimitCategory = "images"
+	RateLimitCategoryReasoningTokens RateLimitCategory = "reasoning_tokens"
+)
+
+// RateLimitReasonCode 描述触发限流的上游原因
+type RateLimitReasonCode string
+
+const (
+	RateLimitReasonQuotaExceeded RateLimitReasonCode = "quota_exceeded"
+	RateLimitReasonOverloaded    RateLimitReasonCode = "overloaded"
+	RateLimitReasonSafety        RateLimitReasonCode = "safety"
+	RateLimitReasonUpstream429   RateLimitReasonCode = "upstream_429"
+)
+
+// RateLimitEntry 是登记簿中的一条限流记录。
+// 仅 Scope 对应的维度字段有意义，例如 Scope == RateLimitScopeModel 时才会读取 Model。
+type RateLimitEntry struct {
+	Scope        RateLimitScope
+	Category     RateLimitCategory
+	ModelFamily  AntigravityQuotaScope
+	Model        string
+	CredentialID string
+	ReasonCode   RateLimitReasonCode
+	RetryAfter   time.Time
+}
+
+// expired 判断记录在 now 时刻是否已失效（零值视为无限流）
+func (e RateLimitEntry) expired(now time.Time) bool {
+	return e.RetryAfter.IsZero() || !e.RetryAfter.After(now)
+}
+
+// key 返回该记录在登记簿中的去重标识：相同维度的新记录会覆盖旧记录
+func (e RateLimitEntry) key() string {
+	return string(e.Scope) + "|" + string(e.Category) + "|" + string(e.ModelFamily) + "|" + e.Model + "|" + e.CredentialID
+}
+
+// matches 判断该记录是否覆盖给定的 (model, category, credential) 三元组
+func (e RateLimitEntry) matches(requestedModel string, category RateLimitCategory, credentialID string) bool {
+	if e.Category != "" && category != "" && e.Category != category {
+		return false
+	}
+	switch e.Scope {
+	case RateLimitScopeAccountGlobal, RateLimitScopePlatform:
+		return true
+	case RateLimitScopeModelFamily:
+		family, ok := resolveAntigravityQuotaScope(requestedModel)
+		return ok && family == e.ModelFamily
+	case RateLimitScopeModel:
+		return e.Model != "" && e.Model == requestedModel
+	case RateLimitScopeCredential:
+		return e.CredentialID != "" && e.CredentialID == credentialID
+	default:
+		return false
+	}
+}
+
+// RecordRateLimit 登记一条限流记录。若登记簿中已存在相同维度（Scope/Category/
+// ModelFamily/Model/CredentialID）的记录，则用新记录覆盖，而不是无限堆积。
+func (a *Account) RecordRateLimit(entry RateLimitEntry) {
+	if a == nil {
+		return
+	}
+	a.rateLimitMu.Lock()
+	defer a.rateLimitMu.Unlock()
+
+	key := entry.key()
+	for i := range a.RateLimits {
+		if a.RateLimits[i].key() == key {
+			a.RateLimits[i] = entry
+			return
+		}
+	}
+	a.RateLimits = append(a.RateLimits, entry)
+}
+
+// credentialIdentifier 返回用于 RateLimitScopeCredential 匹配的凭证标识
+func (a *Account) credentialIdentifier() string {
+	if id, ok := a.Credentials["id"].(string); ok {
+		return id
+	}
+	return ""
+}
+
+// MatchingLimits 返回所有命中给定 (model, category) 且尚未过期的限流记录，
+// 同时包含结构化登记簿（RateLimits）与 Extra[modelRateLimitsKey] 中的历史记录。
+// category 传空字符串表示不按类别过滤。
+func (a *Account) MatchingLimits(requestedModel string, category RateLimitCategory) []RateLimitEntry {
+	if a == nil {
+		return nil
+	}
+	now := time.Now()
+	credentialID := a.credentialIdentifier()
+	mapped := a.GetMappedModel(requestedModel)
+
+	var matched []RateLimitEntry
+	for _, entry := range a.allRateLimitEntries() {
+		if entry.expired(now) {
+			continue
+		}
+		if entry.matches(mapped, category, credentialID) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
+
+// allRateLimitEntries 合并结构化登记簿与 Extra[modelRateLimitsKey] 中的历史限流记录。
+// 持有 rateLimitMu 覆盖整个读取（包括可能触发的历史格式迁移），
+// 避免迁移写入与其他并发读写发生数据竞争。
+func (a *Account) allRateLimitEntries() []RateLimitEntry {
+	a.rateLimitMu.Lock()
+	defer a.rateLimitMu.Unlock()
+
+	entries := append([]RateLimitEntry(nil), a.RateLimits...)
+	entries = append(entries, a.typedExtraRateLimitEntriesLocked()...)
+	return entries
+}
+
+// knownRateLimitFamilies 是 Extra 中可能出现的 AntigravityQuotaScope 字面量，
+// 用于在历史数据里区分"模型族限流"与"具体模型限流"两种 key。
+var knownRateLimitFamilies = map[AntigravityQuotaScope]bool{
+	AntigravityQuotaScopeClaude:      true,
+	AntigravityQuotaScopeGeminiText:  true,
+	AntigravityQuotaScopeGeminiImage: true,
+}
+
+// isModelRateLimitedWithContext 判断账号对该模型是否处于限流中，
+// 即登记簿里是否存在未过期且命中该模型的限流记录。不区分 category。
+func (a *Account) isModelRateLimitedWithContext(ctx context.Context, requestedModel string) bool {
+	return a.isModelRateLimitedForCategoryWithContext(ctx, requestedModel, "")
+}
+
+// isModelRateLimitedForCategoryWithContext 判断账号对该模型、该 category 是否处于限流中。
+// category 传空字符串等价于 isModelRateLimitedWithContext（不按类别过滤）。
+func (a *Account) isModelRateLimitedForCategoryWithContext(ctx context.Context, requestedModel string, category RateLimitCategory) bool {
+	return a.GetModelRateLimitRemainingTimeForCategory(ctx, requestedModel, category) > 0
+}
+
+// GetModelRateLimitRemainingTimeWithContext 获取模型级限流的剩余时间，不区分 category。
+func (a *Account) GetModelRateLimitRemainingTimeWithContext(ctx context.Context, requestedModel string) time.Duration {
+	return a.GetModelRateLimitRemainingTimeForCategory(ctx, requestedModel, "")
+}
+
+// GetModelRateLimitRemainingTimeForCategory 获取模型级限流的剩余时间，只统计命中给定
+// category 的记录（例如调度 image 请求时不应该被一条只限流 output_tokens 的记录挡住）。
+// category 传空字符串表示不按类别过滤，退化为 GetModelRateLimitRemainingTimeWithContext 的行为。
+//
+// 一次请求可能同时命中多个 scope（例如 claude 模型族限流 + 该模型单独限流），
+// 此时返回所有命中记录中最长的剩余时间，确保调用方拿到的是真正可用的时间点。
+func (a *Account) GetModelRateLimitRemainingTimeForCategory(ctx context.Context, requestedModel string, category RateLimitCategory) time.Duration {
+	if a == nil {
+		return 0
+	}
+	var longest time.Duration
+	for _, entry := range a.MatchingLimits(requestedModel, category) {
+		if remaining := time.Until(entry.RetryAfter); remaining > longest {
+			longest = remaining
+		}
+	}
+	return longest
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// errNotEpochSeconds 表示字符串不是纯数字形式的 epoch 秒数，调用方应退回按
+// RFC3339 解析
+var errNotEpochSeconds = errors.New("not an epoch seconds string")
+
+// ModelRateLimit 是持久化在 Account.Extra[modelRateLimitsKey] 下的单条限流记录，
+// 取代此前 map[string]any + 字符串化 RFC3339 时间戳的存法。
+//
+// ResetAt 为零值表示"当前无限流"。序列化时始终输出 UTC ISO-8601，
+// 反序列化时同时兼容 ISO 字符串与上游 Retry-After 风格的 epoch 秒数。
+type ModelRateLimit struct {
+	ResetAt        time.Time
+	RecordedAt     time.Time
+	Source         string
+	RawResetHeader string
+}
+
+// modelRateLimitJSON 是 ModelRateLimit 的 JSON 线格式
+type modelRateLimitJSON struct {
+	ResetAt        string `json:"rate_limit_reset_at,omitempty"`
+	RecordedAt     string `json:"recorded_at,omitempty"`
+	Source         string `json:"source,omitempty"`
+	RawResetHeader string `json:"raw_reset_header,omitempty"`
+}
+
+// MarshalJSON 始终以 UTC ISO-8601 输出时间字段；零值时间对应的字段直接省略，
+// 代表"无限流"，而不是 1970-01-01。
+func (m ModelRateLimit) MarshalJSON() ([]byte, error) {
+	out := modelRateLimitJSON{
+		Source:         m.Source,
+		RawResetHeader: m.RawResetHeader,
+	}
+	if !m.ResetAt.IsZero() {
+		out.ResetAt = m.ResetAt.UTC().Format(time.RFC3339)
+	}
+	if !m.RecordedAt.IsZero() {
+		out.RecordedAt = m.RecordedAt.UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON 兼容两种 rate_limit_reset_at 取值：ISO-8601 字符串，
+// 或上游 Retry-After: 60 风格换算出的 epoch 秒数（以数字或数字字符串形式出现）。
+// 空字符串、"0" 或缺省都视为"无限流"。
+func (m *ModelRateLimit) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		ResetAt        json.RawMessage `json:"rate_limit_reset_at"`
+		RecordedAt     string          `json:"recorded_at"`
+		Source         string          `json:"source"`
+		RawResetHeader string          `json:"raw_reset_header"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	resetAt, err := parseRateLimitTimestamp(raw.ResetAt)
+	if err != nil {
+		return err
+	}
+
+	m.ResetAt = resetAt
+	m.Source = raw.Source
+	m.RawResetHeader = raw.RawResetHeader
+	if raw.RecordedAt != "" {
+		if recordedAt, err := time.Parse(time.RFC3339, raw.RecordedAt); err == nil {
+			m.RecordedAt = recordedAt.UTC()
+		}
+	}
+	return nil
+}
+
+// parseRateLimitTimestamp 解析 rate_limit_reset_at 字段，兼容 ISO-8601 字符串、
+// epoch 秒数字与 epoch 秒数的字符串形式；空值、"0" 一律解析为零值（无限流）。
+func parseRateLimitTimestamp(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+
+	var asNumber float64
+	if err := json.Unmarshal(raw, &asNumber); err == nil {
+		if asNumber == 0 {
+			return time.Time{}, nil
+		}
+		return time.Unix(int64(asNumber), 0).UTC(), nil
+	}
+
+	var asString string
+	if err := json.Unmarshal(raw, &asString); err != nil {
+		return time.Time{}, err
+	}
+	if asString == "" || asString == "0" {
+		return time.Time{}, nil
+	}
+	if epoch, err := parseEpochSecondsString(asString); err == nil {
+		if epoch == 0 {
+			return time.Time{}, nil
+		}
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, asString)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// parseEpochSecondsString 尝试把字符串当作十进制 epoch 秒数解析，
+// 非纯数字字符串（例如 ISO-8601）会返回错误，由调用方退回按时间格式解析。
+func parseEpochSecondsString(s string) (int64, error) {
+	var n int64
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, errNotEpochSeconds
+		}
+		n = n*10 + int64(s[i]-'0')
+	}
+	if len(s) == 0 {
+		return 0, errNotEpochSeconds
+	}
+	return n, nil
+}
+
+// typedExtraRateLimitEntriesLocked 读取 Extra[modelRateLimitsKey] 下的限流记录并转换为
+// RateLimitEntry。首次访问时会把历史的 map[string]any 格式原地迁移为
+// map[string]ModelRateLimit，此后的调度热路径直接使用已解析好的 time.Time，
+// 不再需要每次调用都 time.Parse。
+// 调用方必须已经持有 a.rateLimitMu（参见 allRateLimitEntries）。
+func (a *Account) typedExtraRateLimitEntriesLocked() []RateLimitEntry {
+	a.ensureModelRateLimitsMigratedLocked()
+
+	typed, ok := a.Extra[modelRateLimitsKey].(map[string]ModelRateLimit)
+	if !ok {
+		return nil
+	}
+
+	var entries []RateLimitEntry
+	for key, rl := range typed {
+		if rl.ResetAt.IsZero() {
+			continue
+		}
+		if knownRateLimitFamilies[AntigravityQuotaScope(key)] {
+			entries = append(entries, RateLimitEntry{
+				Scope:       RateLimitScopeModelFamily,
+				ModelFamily: AntigravityQuotaScope(key),
+				ReasonCode:  RateLimitReasonUpstream429,
+				RetryAfter:  rl.ResetAt,
+			})
+			continue
+		}
+		entries = append(entries, RateLimitEntry{
+			Scope:      RateLimitScopeModel,
+			Model:      key,
+			ReasonCode: RateLimitReasonUpstream429,
+			RetryAfter: rl.ResetAt,
+		})
+	}
+	return entries
+}
+
+// ensureModelRateLimitsMigrated 把 Extra[modelRateLimitsKey] 下遗留的
+// map[string]any（值为 {"rate_limit_reset_at": "<RFC3339 字符串>"}）原地迁移为
+// map[string]ModelRateLimit。已经是新格式或没有记录时直接返回，迁移只发生一次。
+// 供直接调用方使用（自己获取锁）；调度热路径走 ensureModelRateLimitsMigratedLocked。
+func (a *Account) ensureModelRateLimitsMigrated() {
+	if a == nil {
+		return
+	}
+	a.rateLimitMu.Lock()
+	defer a.rateLimitMu.Unlock()
+	a.ensureModelRateLimitsMigratedLocked()
+}
+
+// ensureModelRateLimitsMigratedLocked 是 ensureModelRateLimitsMigrated 的实际实现，
+// 调用方必须已经持有 a.rateLimitMu。
+func (a *Account) ensureModelRateLimitsMigratedLocked() {
+	if a == nil || a.Extra == nil {
+		return
+	}
+	raw, ok := a.Extra[modelRateLimitsKey]
+	if !ok {
+		return
+	}
+	if _, already := raw.(map[string]ModelRateLimit); already {
+		return
+	}
+	legacy, ok := raw.(map[string]any)
+	if !ok {
+		return
+	}
+
+	migrated := make(map[string]ModelRateLimit, len(legacy))
+	for key, v := range legacy {
+		entry, ok := parseLegacyModelRateLimit(v)
+		if !ok {
+			continue
+		}
+		migrated[key] = entry
+	}
+	a.Extra[modelRateLimitsKey] = migrated
+}
+
+// parseLegacyModelRateLimit 解析旧格式的单条记录：{"rate_limit_reset_at": "..."}
+func parseLegacyModelRateLimit(v any) (ModelRateLimit, bool) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return ModelRateLimit{}, false
+	}
+	resetAtRaw, ok := m["rate_limit_reset_at"].(string)
+	if !ok || resetAtRaw == "" {
+		return ModelRateLimit{}, false
+	}
+	resetAt, err := time.Parse(time.RFC3339, resetAtRaw)
+	if err != nil {
+		return ModelRateLimit{}, false
+	}
+	return ModelRateLimit{
+		ResetAt: resetAt.UTC(),
+		Source:  "legacy_migration",
+	}, true
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestModelRateLimit_MarshalJSON_UTC(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("failed to load location: %v", err)
+	}
+	resetAt := time.Date(2026, 1, 2, 3, 0, 0, 0, loc)
+
+	data, err := json.Marshal(ModelRateLimit{ResetAt: resetAt, Source: "anthropic-ratelimit-requests-reset"})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode marshaled json: %v", err)
+	}
+	got, _ := decoded["rate_limit_reset_at"].(string)
+	want := resetAt.UTC().Format(time.RFC3339)
+	if got != want {
+		t.Errorf("rate_limit_reset_at = %q, want %q", got, want)
+	}
+}
+
+func TestModelRateLimit_UnmarshalJSON(t *testing.T) {
+	future := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	epoch := time.Now().Add(60 * time.Second).Truncate(time.Second)
+	epochJSON, err := json.Marshal(epoch.Unix())
+	if err != nil {
+		t.Fatalf("failed to marshal epoch fixture: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		wantZero    bool
+		wantSeconds int64
+	}{
+		{
+			name:        "iso8601 string",
+			body:        `{"rate_limit_reset_at":"` + future.UTC().Format(time.RFC3339) + `"}`,
+			wantSeconds: future.Unix(),
+		},
+		{
+			name:        "epoch seconds number",
+			body:        `{"rate_limit_reset_at":` + string(epochJSON) + `}`,
+			wantSeconds: epoch.Unix(),
+		},
+		{
+			name:     "empty string is no limit",
+			body:     `{"rate_limit_reset_at":""}`,
+			wantZero: true,
+		},
+		{
+			name:     "missing field is no limit",
+			body:     `{}`,
+			wantZero: true,
+		},
+		{
+			name:     "zero epoch is no limit",
+			body:     `{"rate_limit_reset_at":0}`,
+			wantZero: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rl ModelRateLimit
+			if err := json.Unmarshal([]byte(tt.body), &rl); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if tt.wantZero {
+				if !rl.ResetAt.IsZero() {
+					t.Errorf("ResetAt = %v, want zero", rl.ResetAt)
+				}
+				return
+			}
+			if rl.ResetAt.Unix() != tt.wantSeconds {
+				t.Errorf("ResetAt.Unix() = %d, want %d", rl.ResetAt.Unix(), tt.wantSeconds)
+			}
+		})
+	}
+}
+
+func TestEnsureModelRateLimitsMigrated_UpgradesLegacyStringFormat(t *testing.T) {
+	future := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
+	account := &Account{
+		Extra: map[string]any{
+			modelRateLimitsKey: map[string]any{
+				"claude": map[string]any{
+					"rate_limit_reset_at": future,
+				},
+				"gemini-3-pro-high": map[string]any{
+					"rate_limit_reset_at": future,
+				},
+				"malformed": map[string]any{
+					"rate_limit_reset_at": "not-a-timestamp",
+				},
+			},
+		},
+	}
+
+	account.ensureModelRateLimitsMigrated()
+
+	typed, ok := account.Extra[modelRateLimitsKey].(map[string]ModelRateLimit)
+	if !ok {
+		t.Fatalf("expected Extra[%s] to be migrated to map[string]ModelRateLimit", modelRateLimitsKey)
+	}
+	if len(typed) != 2 {
+		t.Fatalf("expected 2 valid entries to survive migration, got %d: %+v", len(typed), typed)
+	}
+	if typed["claude"].ResetAt.IsZero() {
+		t.Error("expected claude entry to carry a non-zero ResetAt after migration")
+	}
+	if typed["claude"].Source != "legacy_migration" {
+		t.Errorf("expected migrated entry to be tagged with Source, got %q", typed["claude"].Source)
+	}
+
+	// Migration must be idempotent: running it again on the already-typed map is a no-op.
+	account.ensureModelRateLimitsMigrated()
+	if _, ok := account.Extra[modelRateLimitsKey].(map[string]ModelRateLimit); !ok {
+		t.Fatal("expected second migration call to leave the typed map untouched")
+	}
+}
+
+func TestIsModelRateLimited_WorksThroughMigratedLegacyData(t *testing.T) {
+	future := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
+	account := &Account{
+		Platform: PlatformAntigravity,
+		Extra: map[string]any{
+			modelRateLimitsKey: map[string]any{
+				"claude": map[string]any{
+					"rate_limit_reset_at": future,
+				},
+			},
+		},
+	}
+
+	if !account.isModelRateLimitedWithContext(context.Background(), "claude-sonnet-4-5") {
+		t.Error("expected legacy Extra data to still be honored via automatic migration")
+	}
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRateLimitRegistry_ConcurrentAccess exercises concurrent readers (the scheduling
+// hot path) against concurrent writers (RecordRateLimit / IngestUpstreamRateLimit,
+// as invoked from upstream 429 handlers) on the same *Account. It's meant to be run
+// with `go test -race`: without the rateLimitMu guard around RateLimits and the
+// Extra[modelRateLimitsKey] migration, this reliably trips the race detector.
+func TestRateLimitRegistry_ConcurrentAccess(t *testing.T) {
+	future := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
+	account := &Account{
+		Platform: PlatformAntigravity,
+		Extra: map[string]any{
+			modelRateLimitsKey: map[string]any{
+				"claude": map[string]any{
+					"rate_limit_reset_at": future,
+				},
+			},
+		},
+	}
+
+	var wg sync.WaitGroup
+	const goroutines = 16
+	wg.Add(goroutines * 2)
+
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			account.isModelRateLimitedWithContext(context.Background(), "claude-sonnet-4-5")
+		}()
+		go func(i int) {
+			defer wg.Done()
+			header := http.Header{}
+			header.Set("Retry-After", "30")
+			resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: header}
+			IngestUpstreamRateLimit(context.Background(), account, "claude-opus-4-6", resp)
+		}(i)
+	}
+	wg.Wait()
+}
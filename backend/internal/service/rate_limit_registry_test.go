@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecordRateLimit_OverwritesSameDimension(t *testing.T) {
+	account := &Account{Platform: PlatformAntigravity}
+	now := time.Now()
+
+	account.RecordRateLimit(RateLimitEntry{
+		Scope:       RateLimitScopeModelFamily,
+		ModelFamily: AntigravityQuotaScopeClaude,
+		ReasonCode:  RateLimitReasonUpstream429,
+		RetryAfter:  now.Add(5 * time.Minute),
+	})
+	account.RecordRateLimit(RateLimitEntry{
+		Scope:       RateLimitScopeModelFamily,
+		ModelFamily: AntigravityQuotaScopeClaude,
+		ReasonCode:  RateLimitReasonQuotaExceeded,
+		RetryAfter:  now.Add(10 * time.Minute),
+	})
+
+	if len(account.RateLimits) != 1 {
+		t.Fatalf("expected overwrite to keep a single entry, got %d", len(account.RateLimits))
+	}
+	if account.RateLimits[0].ReasonCode != RateLimitReasonQuotaExceeded {
+		t.Errorf("expected newer entry to win, got reason %q", account.RateLimits[0].ReasonCode)
+	}
+}
+
+func TestMatchingLimits_LongestRetryAfterWins(t *testing.T) {
+	now := time.Now()
+	account := &Account{Platform: PlatformAntigravity}
+
+	// claude 模型族整体限流 5 分钟
+	account.RecordRateLimit(RateLimitEntry{
+		Scope:       RateLimitScopeModelFamily,
+		ModelFamily: AntigravityQuotaScopeClaude,
+		Category:    RateLimitCategoryRequests,
+		ReasonCode:  RateLimitReasonUpstream429,
+		RetryAfter:  now.Add(5 * time.Minute),
+	})
+	// 同时该具体模型因为输出 token 超限被限流 20 分钟
+	account.RecordRateLimit(RateLimitEntry{
+		Scope:      RateLimitScopeModel,
+		Model:      "claude-sonnet-4-5",
+		Category:   RateLimitCategoryOutputTokens,
+		ReasonCode: RateLimitReasonQuotaExceeded,
+		RetryAfter: now.Add(20 * time.Minute),
+	})
+
+	remaining := account.GetModelRateLimitRemainingTimeWithContext(context.Background(), "claude-sonnet-4-5")
+	if remaining < 19*time.Minute || remaining > 21*time.Minute {
+		t.Errorf("expected longest remaining time (~20m) to win, got %v", remaining)
+	}
+
+	// 只按 requests 分类查询时，只有 requests 类别的模型族记录命中，
+	// 这里确认 category 过滤确实把 output_tokens 那条挡在外面。
+	matches := account.MatchingLimits("claude-sonnet-4-5", RateLimitCategoryRequests)
+	if len(matches) != 1 || matches[0].Scope != RateLimitScopeModelFamily {
+		t.Fatalf("expected only the requests-scoped family entry to match, got %+v", matches)
+	}
+}
+
+func TestIsSchedulableForModelAndCategoryWithContext_OnlyBlocksMatchingCategory(t *testing.T) {
+	now := time.Now()
+	account := &Account{Platform: PlatformClaude}
+
+	// 该模型只有 output_tokens 维度被限流，requests/input_tokens 等其他类别应当不受影响。
+	account.RecordRateLimit(RateLimitEntry{
+		Scope:      RateLimitScopeModel,
+		Model:      "claude-sonnet-4-5",
+		Category:   RateLimitCategoryOutputTokens,
+		ReasonCode: RateLimitReasonQuotaExceeded,
+		RetryAfter: now.Add(10 * time.Minute),
+	})
+
+	ctx := context.Background()
+	if account.IsSchedulableForModelAndCategoryWithContext(ctx, "claude-sonnet-4-5", RateLimitCategoryRequests) != true {
+		t.Error("expected requests category to remain schedulable while only output_tokens is rate limited")
+	}
+	if account.IsSchedulableForModelAndCategoryWithContext(ctx, "claude-sonnet-4-5", RateLimitCategoryOutputTokens) {
+		t.Error("expected output_tokens category to be blocked")
+	}
+	if account.IsSchedulableForModelAndCategoryWithContext(ctx, "claude-sonnet-4-5", "") {
+		t.Error("expected unfiltered (category-less) query to still see the output_tokens rate limit")
+	}
+}
+
+func TestMatchingLimits_CredentialScope(t *testing.T) {
+	now := time.Now()
+	account := &Account{
+		Credentials: map[string]any{"id": "cred-123"},
+	}
+	account.RecordRateLimit(RateLimitEntry{
+		Scope:        RateLimitScopeCredential,
+		CredentialID: "cred-123",
+		ReasonCode:   RateLimitReasonOverloaded,
+		RetryAfter:   now.Add(2 * time.Minute),
+	})
+
+	if !account.isModelRateLimitedWithContext(context.Background(), "claude-sonnet-4-5") {
+		t.Error("expected credential-scoped rate limit to apply regardless of requested model")
+	}
+
+	other := &Account{Credentials: map[string]any{"id": "cred-999"}}
+	other.RateLimits = account.RateLimits
+	if other.isModelRateLimitedWithContext(context.Background(), "claude-sonnet-4-5") {
+		t.Error("credential-scoped rate limit should not apply to a different credential id")
+	}
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// anthropicRateLimitResetHeaders 把 Anthropic 的 anthropic-ratelimit-*-reset
+// 响应头族映射到对应的限流类别。用切片而非 map 以保证处理顺序稳定。
+var anthropicRateLimitResetHeaders = []struct {
+	Header   string
+	Category RateLimitCategory
+}{
+	{Header: "anthropic-ratelimit-requests-reset", Category: RateLimitCategoryRequests},
+	{Header: "anthropic-ratelimit-input-tokens-reset", Category: RateLimitCategoryInputTokens},
+	{Header: "anthropic-ratelimit-output-tokens-reset", Category: RateLimitCategoryOutputTokens},
+}
+
+// IngestUpstreamRateLimit 解析 Claude/Gemini/Antigravity 上游返回的 429 或配额耗尽响应，
+// 并据此在账号上登记限流记录（通常一条；带多个 anthropic-ratelimit-*-reset 头时每族各一条），
+// 调用方不需要自己计算 scope key。
+// 返回 true 表示识别出了限流信号并已登记；返回 false 表示该响应没有可识别的限流信息。
+func IngestUpstreamRateLimit(ctx context.Context, account *Account, requestedModel string, resp *http.Response) bool {
+	if account == nil || resp == nil {
+		return false
+	}
+
+	body := peekUpstreamRateLimitBody(resp)
+	reason, ok := classifyUpstreamRateLimitReason(resp, body)
+	if !ok {
+		return false
+	}
+	scope, family, model := resolveUpstreamRateLimitScope(account, requestedModel)
+
+	// Anthropic 的 429 通常会同时带上 requests/input-tokens/output-tokens 三族 reset
+	// 响应头，各自的恢复时间不同；全部记录下来，而不是只留下其中一个。
+	if anthropicLimits := matchingAnthropicRateLimitHeaders(resp.Header); len(anthropicLimits) > 0 {
+		for _, limit := range anthropicLimits {
+			recordUpstreamRateLimit(account, scope, family, model, limit.Category, reason, limit.RetryAfter)
+		}
+		return true
+	}
+
+	retryAfter, ok := parseUpstreamRateLimitRetryAfter(resp.Header, body, reason)
+	if !ok {
+		return false
+	}
+	recordUpstreamRateLimit(account, scope, family, model, "", reason, retryAfter)
+	return true
+}
+
+// recordUpstreamRateLimit 组装一条 RateLimitEntry 并登记、打日志、计数
+func recordUpstreamRateLimit(account *Account, scope RateLimitScope, family AntigravityQuotaScope, model string, category RateLimitCategory, reason RateLimitReasonCode, retryAfter time.Time) {
+	entry := RateLimitEntry{
+		Scope:       scope,
+		Category:    category,
+		ModelFamily: family,
+		Model:       model,
+		ReasonCode:  reason,
+		RetryAfter:  retryAfter,
+	}
+	account.RecordRateLimit(entry)
+	logUpstreamRateLimit(account, entry)
+	UpstreamRateLimitMetrics.Inc(account.Platform, scope, category, reason)
+}
+
+// resolveUpstreamRateLimitScope 对 Antigravity 账号复用 resolveAntigravityQuotaScope
+// 解析出的模型族 scope，其余平台退回到具体模型 id 维度。
+func resolveUpstreamRateLimitScope(account *Account, requestedModel string) (RateLimitScope, AntigravityQuotaScope, string) {
+	if account.Platform == PlatformAntigravity {
+		if family, ok := resolveAntigravityQuotaScope(requestedModel); ok {
+			return RateLimitScopeModelFamily, family, ""
+		}
+	}
+	return RateLimitScopeModel, "", account.GetMappedModel(requestedModel)
+}
+
+// upstreamRateLimitPeekSize 是探测限流信号时愿意读入内存的响应体前缀大小。
+// 限流/配额响应体通常很小，远用不到这个上限；真正的补全响应可能远大于它，
+// 所以读到的内容必须通过 io.MultiReader 拼回 resp.Body，不能只保留这一段。
+const upstreamRateLimitPeekSize = 64 * 1024
+
+// peekUpstreamRateLimitBody 读取响应体的前缀用于探测 Gemini/Antigravity 的 JSON 限流信号，
+// 并用 io.MultiReader 把已读取的前缀和剩余未读的 resp.Body 拼接回去，
+// 确保调用方之后仍能读到完整、未被截断的响应体（例如一个远大于探测窗口的正常补全）。
+// 成功状态（2xx）永远不会携带限流/配额信号，直接跳过，避免无谓的读取。
+func peekUpstreamRateLimitBody(resp *http.Response) []byte {
+	if resp.Body == nil {
+		return nil
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, upstreamRateLimitPeekSize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(data), resp.Body),
+		Closer: resp.Body,
+	}
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// classifyUpstreamRateLimitReason 判断响应是否携带限流/配额信号，并据此推断 ReasonCode。
+// 返回 false 表示这是一个普通响应，不需要登记任何限流记录。
+func classifyUpstreamRateLimitReason(resp *http.Response, body []byte) (RateLimitReasonCode, bool) {
+	isUpstream429 := resp.StatusCode == http.StatusTooManyRequests
+	quotaExhausted := looksLikeQuotaExhaustedBody(body)
+	if !isUpstream429 && !quotaExhausted {
+		return "", false
+	}
+
+	reason := RateLimitReasonUpstream429
+	if quotaExhausted {
+		reason = RateLimitReasonQuotaExceeded
+	}
+	if looksLikeOverloadedBody(body) {
+		reason = RateLimitReasonOverloaded
+	}
+	return reason, true
+}
+
+// parseUpstreamRateLimitRetryAfter 在 Anthropic 专属的 reset 头族之外，
+// 依次尝试标准 Retry-After、X-RateLimit-Reset 与 Antigravity 配额 JSON。
+// 调用方只会在 classifyUpstreamRateLimitReason 已经判定这是一次限流/配额信号之后
+// 才会调用这里，所以哪怕上游什么明确的恢复时间都没给（很多裸 429 就是这样），
+// 也要退避一个保守的默认窗口，而不是静默放弃——否则账号会被立刻重新调度、再次被打限流。
+func parseUpstreamRateLimitRetryAfter(header http.Header, body []byte, reason RateLimitReasonCode) (time.Time, bool) {
+	if retryAfter, ok := parseRetryAfterHeader(header.Get("Retry-After")); ok {
+		return retryAfter, true
+	}
+	if retryAfter, ok := parseEpochHeader(header.Get("X-RateLimit-Reset")); ok {
+		return retryAfter, true
+	}
+	if retryAfter, ok := parseAntigravityQuotaBody(body); ok {
+		return retryAfter, true
+	}
+	return time.Now().Add(defaultQuotaExhaustedBackoff), true
+}
+
+// defaultQuotaExhaustedBackoff 是在上游未给出 Retry-After / reset 时间时使用的保守退避时长
+const defaultQuotaExhaustedBackoff = 60 * time.Second
+
+// anthropicRateLimitHeaderMatch 是一条命中的 anthropic-ratelimit-*-reset 记录
+type anthropicRateLimitHeaderMatch struct {
+	Category   RateLimitCategory
+	RetryAfter time.Time
+}
+
+// matchingAnthropicRateLimitHeaders 返回所有存在的 anthropic-ratelimit-*-reset 响应头
+// （requests/input-tokens/output-tokens 可能同时出现，各自的恢复时间互不相同），
+// 而不是只取第一个命中的就返回。
+func matchingAnthropicRateLimitHeaders(header http.Header) []anthropicRateLimitHeaderMatch {
+	var matches []anthropicRateLimitHeaderMatch
+	for _, candidate := range anthropicRateLimitResetHeaders {
+		if retryAfter, ok := parseEpochOrRFC3339Header(header.Get(candidate.Header)); ok {
+			matches = append(matches, anthropicRateLimitHeaderMatch{Category: candidate.Category, RetryAfter: retryAfter})
+		}
+	}
+	return matches
+}
+
+// parseRetryAfterHeader 解析标准的 Retry-After 头：delta-seconds 或 HTTP-date
+func parseRetryAfterHeader(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at, true
+	}
+	return time.Time{}, false
+}
+
+// parseEpochHeader 解析 X-RateLimit-Reset 这种纯 epoch 秒数响应头
+func parseEpochHeader(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+// parseEpochOrRFC3339Header 兼容 anthropic-ratelimit-*-reset 头可能出现的两种格式：
+// RFC3339 时间戳，或 epoch 秒数
+func parseEpochOrRFC3339Header(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	return parseEpochHeader(value)
+}
+
+// looksLikeQuotaExhaustedBody 识别 Gemini 的 RESOURCE_EXHAUSTED gRPC 状态体
+func looksLikeQuotaExhaustedBody(body []byte) bool {
+	return bytes.Contains(body, []byte("RESOURCE_EXHAUSTED"))
+}
+
+// looksLikeOverloadedBody 识别 Anthropic/Gemini 常见的"过载"而非"配额耗尽"信号
+func looksLikeOverloadedBody(body []byte) bool {
+	return bytes.Contains(body, []byte("overloaded_error")) || bytes.Contains(body, []byte("UNAVAILABLE"))
+}
+
+// antigravityQuotaBody 是 Antigravity 按 scope 返回的配额耗尽响应体
+type antigravityQuotaBody struct {
+	Scope             string `json:"scope"`
+	RetryAfterSeconds *int64 `json:"retry_after_seconds"`
+	ResetAt           string `json:"reset_at"`
+}
+
+// parseAntigravityQuotaBody 解析 Antigravity 的按 scope 配额 JSON
+func parseAntigravityQuotaBody(body []byte) (time.Time, bool) {
+	if len(body) == 0 {
+		return time.Time{}, false
+	}
+	var parsed antigravityQuotaBody
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return time.Time{}, false
+	}
+	if parsed.RetryAfterSeconds != nil {
+		return time.Now().Add(time.Duration(*parsed.RetryAfterSeconds) * time.Second), true
+	}
+	if parsed.ResetAt != "" {
+		if t, err := time.Parse(time.RFC3339, parsed.ResetAt); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// logUpstreamRateLimit 输出一条结构化日志，方便运营人员在不翻日志全文的情况下
+// 看到触发限流的原因、类别、scope 与恢复时间
+func logUpstreamRateLimit(account *Account, entry RateLimitEntry) {
+	scopeDetail := string(entry.Scope)
+	switch entry.Scope {
+	case RateLimitScopeModelFamily:
+		scopeDetail = string(entry.ModelFamily)
+	case RateLimitScopeModel:
+		scopeDetail = entry.Model
+	}
+	log.Printf(
+		"upstream_rate_limit account_id=%s platform=%s reason_code=%s category=%s scope=%s retry_after=%s",
+		account.ID, account.Platform, entry.ReasonCode, entry.Category, scopeDetail, entry.RetryAfter.UTC().Format(time.RFC3339),
+	)
+}
+
+// UpstreamRateLimitCounter 是 sub2api_upstream_rate_limits_total{platform,scope,category,reason}
+// 的一个最小实现：以 label 组合为 key 的并发安全计数器。实际接入 Prometheus 时，
+// 只需要把 Inc 的实现换成真正的 CounterVec.WithLabelValues(...).Inc()。
+// 导出类型/方法是为了让 /metrics 之类的导出端点和测试都能直接引用它，而不是只能
+// 通过包内部状态间接观察。
+type UpstreamRateLimitCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// UpstreamRateLimitMetrics 是 IngestUpstreamRateLimit 实际写入的计数器单例
+var UpstreamRateLimitMetrics = &UpstreamRateLimitCounter{counts: make(map[string]int64)}
+
+// Inc 按 platform/scope/category/reason 四个 label 自增一次计数
+func (c *UpstreamRateLimitCounter) Inc(platform Platform, scope RateLimitScope, category RateLimitCategory, reason RateLimitReasonCode) {
+	key := strings.Join([]string{string(platform), string(scope), string(category), string(reason)}, "|")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]++
+}
+
+// Snapshot 返回当前各 label 组合下的计数快照，供 /metrics 之类的导出端点使用
+func (c *UpstreamRateLimitCounter) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
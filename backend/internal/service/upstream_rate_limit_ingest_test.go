@@ -0,0 +1,212 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUpstreamResponse(status int, headers map[string]string, body string) *http.Response {
+	header := http.Header{}
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+func TestIngestUpstreamRateLimit_RetryAfterDeltaSeconds(t *testing.T) {
+	account := &Account{ID: "acc-1", Platform: PlatformClaude}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, map[string]string{"Retry-After": "30"}, "")
+
+	if !IngestUpstreamRateLimit(nil, account, "claude-sonnet-4-5", resp) {
+		t.Fatal("expected a rate limit to be recorded")
+	}
+	if len(account.RateLimits) != 1 {
+		t.Fatalf("expected 1 recorded entry, got %d", len(account.RateLimits))
+	}
+	entry := account.RateLimits[0]
+	if entry.Scope != RateLimitScopeModel || entry.Model != "claude-sonnet-4-5" {
+		t.Errorf("expected a model-scoped entry, got %+v", entry)
+	}
+	remaining := time.Until(entry.RetryAfter)
+	if remaining < 20*time.Second || remaining > 40*time.Second {
+		t.Errorf("expected ~30s remaining, got %v", remaining)
+	}
+}
+
+func TestIngestUpstreamRateLimit_RetryAfterHTTPDate(t *testing.T) {
+	at := time.Now().Add(2 * time.Minute).UTC()
+	account := &Account{ID: "acc-1", Platform: PlatformClaude}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, map[string]string{"Retry-After": at.Format(http.TimeFormat)}, "")
+
+	if !IngestUpstreamRateLimit(nil, account, "claude-sonnet-4-5", resp) {
+		t.Fatal("expected a rate limit to be recorded")
+	}
+	remaining := time.Until(account.RateLimits[0].RetryAfter)
+	if remaining < 90*time.Second || remaining > 150*time.Second {
+		t.Errorf("expected ~2m remaining, got %v", remaining)
+	}
+}
+
+func TestIngestUpstreamRateLimit_AnthropicRateLimitHeaders(t *testing.T) {
+	resetAt := time.Now().Add(5 * time.Minute).UTC()
+	account := &Account{ID: "acc-1", Platform: PlatformClaude}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, map[string]string{
+		"anthropic-ratelimit-output-tokens-reset": resetAt.Format(time.RFC3339),
+	}, "")
+
+	if !IngestUpstreamRateLimit(nil, account, "claude-opus-4-6", resp) {
+		t.Fatal("expected a rate limit to be recorded")
+	}
+	entry := account.RateLimits[0]
+	if entry.Category != RateLimitCategoryOutputTokens {
+		t.Errorf("expected output_tokens category, got %q", entry.Category)
+	}
+}
+
+func TestIngestUpstreamRateLimit_AnthropicRateLimitHeaders_AllFamiliesRecorded(t *testing.T) {
+	requestsResetAt := time.Now().Add(5 * time.Second).UTC()
+	outputResetAt := time.Now().Add(10 * time.Minute).UTC()
+	account := &Account{ID: "acc-1", Platform: PlatformClaude}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, map[string]string{
+		"anthropic-ratelimit-requests-reset":      requestsResetAt.Format(time.RFC3339),
+		"anthropic-ratelimit-output-tokens-reset": outputResetAt.Format(time.RFC3339),
+	}, "")
+
+	if !IngestUpstreamRateLimit(nil, account, "claude-opus-4-6", resp) {
+		t.Fatal("expected a rate limit to be recorded")
+	}
+	if len(account.RateLimits) != 2 {
+		t.Fatalf("expected both requests and output_tokens families to be recorded, got %d entries: %+v", len(account.RateLimits), account.RateLimits)
+	}
+
+	byCategory := make(map[RateLimitCategory]RateLimitEntry, len(account.RateLimits))
+	for _, entry := range account.RateLimits {
+		byCategory[entry.Category] = entry
+	}
+	requestsEntry, ok := byCategory[RateLimitCategoryRequests]
+	if !ok {
+		t.Fatal("expected a requests-category entry")
+	}
+	if remaining := time.Until(requestsEntry.RetryAfter); remaining < 0 || remaining > 15*time.Second {
+		t.Errorf("expected requests entry to reset in ~5s, got %v", remaining)
+	}
+	outputEntry, ok := byCategory[RateLimitCategoryOutputTokens]
+	if !ok {
+		t.Fatal("expected an output_tokens-category entry")
+	}
+	if remaining := time.Until(outputEntry.RetryAfter); remaining < 9*time.Minute || remaining > 11*time.Minute {
+		t.Errorf("expected output_tokens entry to reset in ~10m, got %v", remaining)
+	}
+}
+
+func TestIngestUpstreamRateLimit_XRateLimitResetEpoch(t *testing.T) {
+	resetAt := time.Now().Add(90 * time.Second)
+	account := &Account{ID: "acc-1", Platform: PlatformGemini}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, map[string]string{
+		"X-RateLimit-Reset": strconv.FormatInt(resetAt.Unix(), 10),
+	}, "")
+
+	if !IngestUpstreamRateLimit(nil, account, "gemini-3-flash", resp) {
+		t.Fatal("expected a rate limit to be recorded")
+	}
+	remaining := time.Until(account.RateLimits[0].RetryAfter)
+	if remaining < 60*time.Second || remaining > 120*time.Second {
+		t.Errorf("expected ~90s remaining, got %v", remaining)
+	}
+}
+
+func TestIngestUpstreamRateLimit_Bare429FallsBackToDefaultBackoff(t *testing.T) {
+	account := &Account{ID: "acc-1", Platform: PlatformClaude}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, nil, "")
+
+	if !IngestUpstreamRateLimit(nil, account, "claude-sonnet-4-5", resp) {
+		t.Fatal("expected a bare 429 without Retry-After to still be recorded")
+	}
+	if len(account.RateLimits) != 1 {
+		t.Fatalf("expected 1 recorded entry, got %d", len(account.RateLimits))
+	}
+	entry := account.RateLimits[0]
+	if entry.ReasonCode != RateLimitReasonUpstream429 {
+		t.Errorf("expected upstream_429 reason, got %q", entry.ReasonCode)
+	}
+	remaining := time.Until(entry.RetryAfter)
+	if remaining <= 0 || remaining > defaultQuotaExhaustedBackoff {
+		t.Errorf("expected a positive backoff up to %v, got %v", defaultQuotaExhaustedBackoff, remaining)
+	}
+}
+
+func TestIngestUpstreamRateLimit_GeminiResourceExhaustedBody(t *testing.T) {
+	account := &Account{ID: "acc-1", Platform: PlatformGemini}
+	resp := newUpstreamResponse(http.StatusBadRequest, nil, `{"error":{"status":"RESOURCE_EXHAUSTED","message":"quota exceeded"}}`)
+
+	if !IngestUpstreamRateLimit(nil, account, "gemini-3-pro-high", resp) {
+		t.Fatal("expected RESOURCE_EXHAUSTED body to be recognized without a 429 status")
+	}
+	if account.RateLimits[0].ReasonCode != RateLimitReasonQuotaExceeded {
+		t.Errorf("expected quota_exceeded reason, got %q", account.RateLimits[0].ReasonCode)
+	}
+	// The response body must still be readable by the caller after ingestion.
+	remaining, err := io.ReadAll(resp.Body)
+	if err != nil || !bytes.Contains(remaining, []byte("RESOURCE_EXHAUSTED")) {
+		t.Errorf("expected response body to remain readable, got %q (err=%v)", remaining, err)
+	}
+}
+
+func TestIngestUpstreamRateLimit_AntigravityQuotaScopeBody(t *testing.T) {
+	account := &Account{ID: "acc-1", Platform: PlatformAntigravity}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, nil, `{"scope":"claude","retry_after_seconds":45}`)
+
+	if !IngestUpstreamRateLimit(nil, account, "claude-sonnet-4-5", resp) {
+		t.Fatal("expected a rate limit to be recorded")
+	}
+	entry := account.RateLimits[0]
+	if entry.Scope != RateLimitScopeModelFamily || entry.ModelFamily != AntigravityQuotaScopeClaude {
+		t.Errorf("expected antigravity claude family scope, got %+v", entry)
+	}
+}
+
+func TestIngestUpstreamRateLimit_NonRateLimitResponseIsIgnored(t *testing.T) {
+	account := &Account{ID: "acc-1", Platform: PlatformClaude}
+	resp := newUpstreamResponse(http.StatusOK, nil, `{"ok":true}`)
+
+	if IngestUpstreamRateLimit(nil, account, "claude-sonnet-4-5", resp) {
+		t.Error("expected a 200 response without quota signals to be ignored")
+	}
+	if len(account.RateLimits) != 0 {
+		t.Errorf("expected no rate limit to be recorded, got %+v", account.RateLimits)
+	}
+}
+
+func TestIngestUpstreamRateLimit_RecordsMetricsCounter(t *testing.T) {
+	before := UpstreamRateLimitMetrics.Snapshot()
+	account := &Account{ID: "acc-1", Platform: PlatformClaude}
+	resp := newUpstreamResponse(http.StatusTooManyRequests, map[string]string{"Retry-After": "30"}, "")
+
+	if !IngestUpstreamRateLimit(nil, account, "claude-sonnet-4-5", resp) {
+		t.Fatal("expected a rate limit to be recorded")
+	}
+
+	after := UpstreamRateLimitMetrics.Snapshot()
+	key := strings.Join([]string{string(PlatformClaude), string(RateLimitScopeModel), "", string(RateLimitReasonUpstream429)}, "|")
+	if after[key] != before[key]+1 {
+		t.Errorf("expected counter %q to increment by 1, got before=%d after=%d", key, before[key], after[key])
+	}
+}
+
+func TestIngestUpstreamRateLimit_NilAccountOrResponse(t *testing.T) {
+	if IngestUpstreamRateLimit(nil, nil, "claude-sonnet-4-5", newUpstreamResponse(http.StatusTooManyRequests, nil, "")) {
+		t.Error("expected nil account to be a no-op")
+	}
+	if IngestUpstreamRateLimit(nil, &Account{}, "claude-sonnet-4-5", nil) {
+		t.Error("expected nil response to be a no-op")
+	}
+}